@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-webdav"
+	"golang.org/x/oauth2"
+)
+
+// authConfig selects how requests to the CalDAV server are authenticated,
+// as an alternative to the plain Username/Password basic auth in config.
+type authConfig struct {
+	// Type is "basic" (the default, using config.Username/Password),
+	// "bearer" (a fixed Bearer token), or "oauth2" (a refreshable OAuth2
+	// token, cached on disk next to the config file).
+	Type string `json:"type,omitempty"`
+
+	// Token is the bearer token to send, for Type == "bearer".
+	Token string `json:"token,omitempty"`
+
+	// The remaining fields configure an oauth2.Config, for Type == "oauth2".
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	TokenURL     string   `json:"token_url,omitempty"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// buildHTTPClient returns the webdav.HTTPClient to use for config, wrapping
+// the default transport in whichever authentication scheme config.Auth (or,
+// if unset, config.Username/Password) selects. tokenCacheFile is where a
+// refreshed OAuth2 access token is cached between runs.
+func buildHTTPClient(c *config, tokenCacheFile string) (webdav.HTTPClient, error) {
+	switch c.Auth.Type {
+	case "", "basic":
+		if c.Username == "" {
+			return http.DefaultClient, nil
+		}
+		return webdav.HTTPClientWithBasicAuth(nil, c.Username, c.Password), nil
+	case "bearer":
+		if c.Auth.Token == "" {
+			return nil, fmt.Errorf(`auth type "bearer" requires a token`)
+		}
+		return httpClientWithBearerAuth(nil, c.Auth.Token), nil
+	case "oauth2":
+		return oauth2HTTPClient(c.Auth, tokenCacheFile)
+	default:
+		return nil, fmt.Errorf("unknown auth type %q", c.Auth.Type)
+	}
+}
+
+type bearerAuthHTTPClient struct {
+	c     webdav.HTTPClient
+	token string
+}
+
+func (c *bearerAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return c.c.Do(req)
+}
+
+// httpClientWithBearerAuth returns an HTTP client that adds a fixed Bearer
+// token to all outgoing requests. If c is nil, http.DefaultClient is used.
+func httpClientWithBearerAuth(c webdav.HTTPClient, token string) webdav.HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &bearerAuthHTTPClient{c, token}
+}
+
+// oauth2HTTPClient builds an HTTP client whose requests carry an OAuth2
+// access token, refreshed via a.TokenURL as needed and cached in
+// tokenCacheFile so a fresh access token isn't fetched on every run.
+func oauth2HTTPClient(a authConfig, tokenCacheFile string) (webdav.HTTPClient, error) {
+	if a.ClientID == "" || a.TokenURL == "" || a.RefreshToken == "" {
+		return nil, fmt.Errorf(`auth type "oauth2" requires client_id, token_url and refresh_token`)
+	}
+	conf := &oauth2.Config{
+		ClientID:     a.ClientID,
+		ClientSecret: a.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: a.TokenURL},
+		Scopes:       a.Scopes,
+	}
+
+	tok := &oauth2.Token{RefreshToken: a.RefreshToken}
+	if cached, err := readCachedToken(tokenCacheFile); err == nil {
+		tok = cached
+	}
+
+	ctx := context.Background()
+	src := &cachingTokenSource{
+		src:      conf.TokenSource(ctx, tok),
+		filename: tokenCacheFile,
+		cached:   tok,
+	}
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// cachingTokenSource wraps a TokenSource, persisting newly-fetched tokens to
+// filename so a valid access token survives across runs. Token() is called
+// on every outgoing request (it backs an oauth2.Transport), not just when
+// src actually refreshes, so writes are skipped unless the token changed.
+type cachingTokenSource struct {
+	src      oauth2.TokenSource
+	filename string
+
+	cached *oauth2.Token
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if s.cached == nil || tok.AccessToken != s.cached.AccessToken || !tok.Expiry.Equal(s.cached.Expiry) {
+		if err := writeCachedToken(s.filename, tok); err != nil {
+			log.Printf("caching oauth2 token: %v", err)
+		}
+		s.cached = tok
+	}
+	return tok, nil
+}
+
+func readCachedToken(filename string) (*oauth2.Token, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tok oauth2.Token
+	if err := json.NewDecoder(f).Decode(&tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func writeCachedToken(filename string, tok *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(tok)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// cacheConfig bundles what's needed to keep a local on-disk mirror of a
+// calendar: the directory cached objects are stored under, and the raw HTTP
+// client/endpoint used for the getctag PROPFIND (go-webdav has no helper for
+// it; see getCTag). A nil *cacheConfig disables caching entirely.
+type cacheConfig struct {
+	dir      string
+	hclient  webdav.HTTPClient
+	endpoint *url.URL
+}
+
+// cacheIndex is the on-disk index for a single calendar: its last-seen CTag,
+// plus where each object's data is cached, keyed by href.
+type cacheIndex struct {
+	CTag    string                `json:"ctag"`
+	Objects map[string]cacheEntry `json:"objects"`
+}
+
+type cacheEntry struct {
+	ETag string `json:"etag"`
+	File string `json:"file"`
+}
+
+// calendarCacheDir returns the on-disk directory used to cache one
+// calendar's objects, derived from its path so that distinct calendars
+// sharing a CacheDir don't collide.
+func calendarCacheDir(cache *cacheConfig, calendarPath string) string {
+	sum := sha256.Sum256([]byte(calendarPath))
+	return filepath.Join(cache.dir, hex.EncodeToString(sum[:8]))
+}
+
+func loadCacheIndex(dir string) (*cacheIndex, error) {
+	f, err := os.Open(filepath.Join(dir, "index.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cacheIndex{Objects: make(map[string]cacheEntry)}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var idx cacheIndex
+	if err := json.NewDecoder(f).Decode(&idx); err != nil {
+		return nil, err
+	}
+	if idx.Objects == nil {
+		idx.Objects = make(map[string]cacheEntry)
+	}
+	return &idx, nil
+}
+
+func saveCacheIndex(dir string, idx *cacheIndex) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "index.json"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(idx)
+}
+
+// getCTag fetches a calendar collection's CS:getctag property, a cheap way
+// to detect "nothing changed" without listing every object. go-webdav
+// predates RFC 6578 sync-collection and doesn't implement it either, so in
+// both cases we're stuck issuing the requests ourselves.
+func getCTag(ctx context.Context, cache *cacheConfig, calendarPath string) (string, error) {
+	const body = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/">
+  <D:prop><CS:getctag/></D:prop>
+</D:propfind>`
+
+	u := *cache.endpoint
+	u.Path = calendarPath
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", u.String(), strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "0")
+	resp, err := cache.hclient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("PROPFIND %v: %v", u.String(), resp.Status)
+	}
+
+	var ms struct {
+		Responses []struct {
+			Propstat []struct {
+				Prop struct {
+					GetCTag string `xml:"getctag"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return "", err
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.GetCTag != "" {
+				return ps.Prop.GetCTag, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// calendarObjects returns every VEVENT-bearing calendar object in cal whose
+// time range intersects [start, end), either by querying the server
+// directly (cache == nil) or, if caching is enabled, by syncing a local
+// mirror first and reading from that.
+func calendarObjects(ctx context.Context, client *caldav.Client, cache *cacheConfig, cal caldav.Calendar, start, end time.Time) ([]*ical.Calendar, error) {
+	if cache == nil {
+		return fullQueryCalendar(ctx, client, cal, start, end)
+	}
+	return syncCalendarObjects(ctx, client, cache, cal)
+}
+
+// fullQueryCalendar fetches every VEVENT-bearing object in cal directly from
+// the server whose time range intersects [start, end), with all properties
+// (the cache's own full-mirror listing, inside syncCalendarObjects, is the
+// only caller that legitimately needs an unbounded fetch).
+func fullQueryCalendar(ctx context.Context, client *caldav.Client, cal caldav.Calendar, start, end time.Time) ([]*ical.Calendar, error) {
+	objs, err := client.QueryCalendar(ctx, cal.Path, &caldav.CalendarQuery{
+		CompRequest: caldav.CalendarCompRequest{
+			Name:     "VCALENDAR",
+			AllProps: true,
+			Comps:    []caldav.CalendarCompRequest{{Name: "VEVENT", AllProps: true}},
+		},
+		CompFilter: caldav.CompFilter{
+			Name: "VCALENDAR",
+			Comps: []caldav.CompFilter{{
+				Name:  "VEVENT",
+				Start: start,
+				End:   end,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cals := make([]*ical.Calendar, len(objs))
+	for i, o := range objs {
+		cals[i] = o.Data
+	}
+	return cals, nil
+}
+
+// syncCalendarObjects brings the local cache for cal up to date and returns
+// its (now current) contents. If the collection's CTag hasn't changed, the
+// network isn't touched at all; otherwise only the objects whose ETag
+// changed are re-fetched, via MultiGetCalendar.
+func syncCalendarObjects(ctx context.Context, client *caldav.Client, cache *cacheConfig, cal caldav.Calendar) ([]*ical.Calendar, error) {
+	dir := calendarCacheDir(cache, cal.Path)
+	idx, err := loadCacheIndex(dir)
+	if err != nil {
+		return nil, fmt.Errorf("loading cache index: %w", err)
+	}
+
+	ctag, err := getCTag(ctx, cache, cal.Path)
+	if err != nil {
+		if len(idx.Objects) > 0 {
+			log.Printf("getCTag(%v): %v; serving the local cache", cal.Name, err)
+			return loadCachedObjects(dir, idx), nil
+		}
+		log.Printf("getCTag(%v): %v; querying the server directly", cal.Name, err)
+		return fullQueryCalendar(ctx, client, cal, time.Time{}, time.Time{})
+	}
+
+	if ctag != "" && ctag == idx.CTag && len(idx.Objects) > 0 {
+		return loadCachedObjects(dir, idx), nil
+	}
+
+	listing, err := client.QueryCalendar(ctx, cal.Path, &caldav.CalendarQuery{
+		CompRequest: caldav.CalendarCompRequest{
+			Name:  "VCALENDAR",
+			Comps: []caldav.CalendarCompRequest{{Name: "VEVENT", Props: []string{"UID"}}},
+		},
+		CompFilter: caldav.CompFilter{
+			Name:  "VCALENDAR",
+			Comps: []caldav.CompFilter{{Name: "VEVENT"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(listing))
+	var stale []string
+	for _, o := range listing {
+		seen[o.Path] = true
+		if e, ok := idx.Objects[o.Path]; !ok || e.ETag != o.ETag {
+			stale = append(stale, o.Path)
+		}
+	}
+	for href := range idx.Objects {
+		if !seen[href] {
+			removeCachedObject(dir, idx, href)
+		}
+	}
+
+	if len(stale) > 0 {
+		fresh, err := client.MultiGetCalendar(ctx, cal.Path, &caldav.CalendarMultiGet{
+			Paths: stale,
+			CompRequest: caldav.CalendarCompRequest{
+				Name:     "VCALENDAR",
+				AllProps: true,
+				Comps:    []caldav.CalendarCompRequest{{Name: "VEVENT", AllProps: true}},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("MultiGetCalendar: %w", err)
+		}
+		for _, o := range fresh {
+			if err := writeCachedObject(dir, idx, o); err != nil {
+				return nil, fmt.Errorf("caching %v: %w", o.Path, err)
+			}
+		}
+	}
+
+	idx.CTag = ctag
+	if err := saveCacheIndex(dir, idx); err != nil {
+		log.Printf("saving cache index for %v: %v", cal.Name, err)
+	}
+
+	return loadCachedObjects(dir, idx), nil
+}
+
+func objectCacheFile(href string) string {
+	sum := sha256.Sum256([]byte(href))
+	return hex.EncodeToString(sum[:]) + ".ics"
+}
+
+func writeCachedObject(dir string, idx *cacheIndex, o caldav.CalendarObject) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	file := objectCacheFile(o.Path)
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ical.NewEncoder(f).Encode(o.Data); err != nil {
+		return err
+	}
+	idx.Objects[o.Path] = cacheEntry{ETag: o.ETag, File: file}
+	return nil
+}
+
+func removeCachedObject(dir string, idx *cacheIndex, href string) {
+	if e, ok := idx.Objects[href]; ok {
+		os.Remove(filepath.Join(dir, e.File))
+		delete(idx.Objects, href)
+	}
+}
+
+func loadCachedObjects(dir string, idx *cacheIndex) []*ical.Calendar {
+	cals := make([]*ical.Calendar, 0, len(idx.Objects))
+	for href, e := range idx.Objects {
+		f, err := os.Open(filepath.Join(dir, e.File))
+		if err != nil {
+			log.Printf("reading cached object %v: %v", href, err)
+			continue
+		}
+		cal, err := ical.NewDecoder(f).Decode()
+		f.Close()
+		if err != nil {
+			log.Printf("decoding cached object %v: %v", href, err)
+			continue
+		}
+		cals = append(cals, cal)
+	}
+	return cals
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// memCalendarBackend is a minimal in-memory caldav.Backend, just enough to
+// serve the calendar-query and calendar-multiget REPORTs syncCalendarObjects
+// issues. Everything else is unused by these tests.
+type memCalendarBackend struct {
+	objects map[string]caldav.CalendarObject
+}
+
+func (b *memCalendarBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return "/calendars/", nil
+}
+func (b *memCalendarBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return "/principal/", nil
+}
+func (b *memCalendarBackend) CreateCalendar(ctx context.Context, calendar *caldav.Calendar) error {
+	return fmt.Errorf("not supported")
+}
+func (b *memCalendarBackend) ListCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	return []caldav.Calendar{{Path: "/calendars/test/"}}, nil
+}
+func (b *memCalendarBackend) GetCalendar(ctx context.Context, path string) (*caldav.Calendar, error) {
+	return &caldav.Calendar{Path: path}, nil
+}
+func (b *memCalendarBackend) GetCalendarObject(ctx context.Context, path string, req *caldav.CalendarCompRequest) (*caldav.CalendarObject, error) {
+	o, ok := b.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("no calendar object at %v", path)
+	}
+	return &o, nil
+}
+func (b *memCalendarBackend) ListCalendarObjects(ctx context.Context, path string, req *caldav.CalendarCompRequest) ([]caldav.CalendarObject, error) {
+	return b.QueryCalendarObjects(ctx, path, nil)
+}
+func (b *memCalendarBackend) QueryCalendarObjects(ctx context.Context, path string, query *caldav.CalendarQuery) ([]caldav.CalendarObject, error) {
+	objs := make([]caldav.CalendarObject, 0, len(b.objects))
+	for _, o := range b.objects {
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+func (b *memCalendarBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (*caldav.CalendarObject, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (b *memCalendarBackend) DeleteCalendarObject(ctx context.Context, path string) error {
+	return fmt.Errorf("not supported")
+}
+
+// newCalDAVTestServer serves ctag from a getctag PROPFIND (which go-webdav's
+// Handler doesn't implement, so ical's own getCTag talks to it directly; see
+// getCTag in cache.go) and delegates everything else, including the REPORTs
+// syncCalendarObjects issues, to a real caldav.Handler. reportCount, if
+// non-nil, is incremented on every REPORT so tests can assert the network
+// wasn't touched on a cache hit.
+func newCalDAVTestServer(t *testing.T, backend *memCalendarBackend, ctag string, reportCount *int) *httptest.Server {
+	t.Helper()
+	h := &caldav.Handler{Backend: backend}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), "getctag") {
+				w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+				w.WriteHeader(http.StatusMultiStatus)
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/">
+<D:response><D:href>%s</D:href><D:propstat>
+<D:prop><CS:getctag>%s</CS:getctag></D:prop>
+<D:status>HTTP/1.1 200 OK</D:status>
+</D:propstat></D:response>
+</D:multistatus>`, r.URL.Path, ctag)
+				return
+			}
+		}
+		if r.Method == "REPORT" && reportCount != nil {
+			*reportCount++
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+func testEventCalendar(uid, summary string) *ical.Calendar {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropProductID, "-//jech/ical//EN")
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	ev := ical.NewEvent()
+	ev.Props.SetText(ical.PropUID, uid)
+	ev.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ev.Props.SetDateTime(ical.PropDateTimeStart, time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC))
+	ev.Props.SetDateTime(ical.PropDateTimeEnd, time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC))
+	ev.Props.SetText(ical.PropSummary, summary)
+	cal.Children = append(cal.Children, ev.Component)
+	return cal
+}
+
+func eventSummary(t *testing.T, cal *ical.Calendar) string {
+	t.Helper()
+	evs := cal.Events()
+	if len(evs) != 1 {
+		t.Fatalf("calendar has %v events, want 1", len(evs))
+	}
+	s, err := evs[0].Props.Text(ical.PropSummary)
+	if err != nil {
+		t.Fatalf("Props.Text(SUMMARY): %v", err)
+	}
+	return s
+}
+
+// TestSyncCalendarObjectsCacheHit checks that a matching CTag serves the
+// on-disk cache without issuing any REPORT.
+func TestSyncCalendarObjectsCacheHit(t *testing.T) {
+	dir := t.TempDir()
+	cache := &cacheConfig{dir: dir}
+	calPath := "/calendars/test/"
+	cDir := calendarCacheDir(cache, calPath)
+
+	obj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "etag1", Data: testEventCalendar("ev1", "Standup")}
+	idx := &cacheIndex{CTag: "ctag1", Objects: make(map[string]cacheEntry)}
+	if err := writeCachedObject(cDir, idx, obj); err != nil {
+		t.Fatalf("writeCachedObject: %v", err)
+	}
+	if err := saveCacheIndex(cDir, idx); err != nil {
+		t.Fatalf("saveCacheIndex: %v", err)
+	}
+
+	var reportCount int
+	backend := &memCalendarBackend{objects: map[string]caldav.CalendarObject{obj.Path: obj}}
+	srv := newCalDAVTestServer(t, backend, "ctag1", &reportCount)
+	defer srv.Close()
+
+	endpoint, _ := url.Parse(srv.URL)
+	cache.endpoint = endpoint
+	cache.hclient = srv.Client()
+	client, err := caldav.NewClient(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	cals, err := syncCalendarObjects(context.Background(), client, cache, caldav.Calendar{Path: calPath, Name: "test"})
+	if err != nil {
+		t.Fatalf("syncCalendarObjects: %v", err)
+	}
+	if len(cals) != 1 || eventSummary(t, cals[0]) != "Standup" {
+		t.Fatalf("syncCalendarObjects returned %v calendars, want the cached one", len(cals))
+	}
+	if reportCount != 0 {
+		t.Errorf("syncCalendarObjects issued %v REPORTs on a cache hit, want 0", reportCount)
+	}
+}
+
+// TestSyncCalendarObjectsStaleRefetches checks that a changed CTag causes a
+// re-fetch of the changed object and updates the on-disk cache.
+func TestSyncCalendarObjectsStaleRefetches(t *testing.T) {
+	dir := t.TempDir()
+	cache := &cacheConfig{dir: dir}
+	calPath := "/calendars/test/"
+	cDir := calendarCacheDir(cache, calPath)
+
+	oldObj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "etag1", Data: testEventCalendar("ev1", "Standup")}
+	idx := &cacheIndex{CTag: "ctag1", Objects: make(map[string]cacheEntry)}
+	if err := writeCachedObject(cDir, idx, oldObj); err != nil {
+		t.Fatalf("writeCachedObject: %v", err)
+	}
+	if err := saveCacheIndex(cDir, idx); err != nil {
+		t.Fatalf("saveCacheIndex: %v", err)
+	}
+
+	newObj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "etag2", Data: testEventCalendar("ev1", "Standup (moved)")}
+	backend := &memCalendarBackend{objects: map[string]caldav.CalendarObject{newObj.Path: newObj}}
+	srv := newCalDAVTestServer(t, backend, "ctag2", nil)
+	defer srv.Close()
+
+	endpoint, _ := url.Parse(srv.URL)
+	cache.endpoint = endpoint
+	cache.hclient = srv.Client()
+	client, err := caldav.NewClient(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	cals, err := syncCalendarObjects(context.Background(), client, cache, caldav.Calendar{Path: calPath, Name: "test"})
+	if err != nil {
+		t.Fatalf("syncCalendarObjects: %v", err)
+	}
+	if len(cals) != 1 || eventSummary(t, cals[0]) != "Standup (moved)" {
+		t.Fatalf("syncCalendarObjects returned %v calendars, want the refetched one", len(cals))
+	}
+
+	newIdx, err := loadCacheIndex(cDir)
+	if err != nil {
+		t.Fatalf("loadCacheIndex: %v", err)
+	}
+	if newIdx.CTag != "ctag2" {
+		t.Errorf("cache index CTag = %q, want %q", newIdx.CTag, "ctag2")
+	}
+	if e := newIdx.Objects[newObj.Path]; e.ETag != "etag2" {
+		t.Errorf("cache index ETag = %q, want %q", e.ETag, "etag2")
+	}
+}
+
+// erroringHTTPClient simulates a network that's unreachable.
+type erroringHTTPClient struct{}
+
+func (erroringHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("network unreachable")
+}
+
+// TestSyncCalendarObjectsOfflineFallback checks that, per the request this
+// feature exists for, a network error falls back to the on-disk cache
+// instead of trying (and failing) another network round-trip.
+func TestSyncCalendarObjectsOfflineFallback(t *testing.T) {
+	dir := t.TempDir()
+	cache := &cacheConfig{
+		dir:      dir,
+		hclient:  erroringHTTPClient{},
+		endpoint: &url.URL{Scheme: "http", Host: "example.invalid"},
+	}
+	calPath := "/calendars/test/"
+	cDir := calendarCacheDir(cache, calPath)
+
+	obj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "etag1", Data: testEventCalendar("ev1", "Standup")}
+	idx := &cacheIndex{CTag: "ctag1", Objects: make(map[string]cacheEntry)}
+	if err := writeCachedObject(cDir, idx, obj); err != nil {
+		t.Fatalf("writeCachedObject: %v", err)
+	}
+	if err := saveCacheIndex(cDir, idx); err != nil {
+		t.Fatalf("saveCacheIndex: %v", err)
+	}
+
+	client, err := caldav.NewClient(erroringHTTPClient{}, "http://example.invalid/")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	cals, err := syncCalendarObjects(context.Background(), client, cache, caldav.Calendar{Path: calPath, Name: "test"})
+	if err != nil {
+		t.Fatalf("syncCalendarObjects: %v, want the cache served despite the network error", err)
+	}
+	if len(cals) != 1 || eventSummary(t, cals[0]) != "Standup" {
+		t.Fatalf("syncCalendarObjects returned %v calendars, want the cached one", len(cals))
+	}
+}
+
+// TestSyncCalendarObjectsOfflineNoCache checks that a network error with
+// nothing cached yet still surfaces an error, rather than silently
+// returning no events.
+func TestSyncCalendarObjectsOfflineNoCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := &cacheConfig{
+		dir:      dir,
+		hclient:  erroringHTTPClient{},
+		endpoint: &url.URL{Scheme: "http", Host: "example.invalid"},
+	}
+	client, err := caldav.NewClient(erroringHTTPClient{}, "http://example.invalid/")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	_, err = syncCalendarObjects(context.Background(), client, cache, caldav.Calendar{Path: "/calendars/test/", Name: "test"})
+	if err == nil {
+		t.Fatal("syncCalendarObjects() = nil error, want an error with no cache and no network")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// fbInterval is a merged free/busy interval.
+type fbInterval struct {
+	start, end time.Time
+	fbtype     string // "BUSY" or "BUSY-TENTATIVE"
+}
+
+func cmdFreeBusy(client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, args []string, cache *cacheConfig) error {
+	fs := flag.NewFlagSet("freebusy", flag.ExitOnError)
+	var startStr, endStr, format string
+	fs.StringVar(&startStr, "start", "", "start of the window (required)")
+	fs.StringVar(&endStr, "end", "", "end of the window (required)")
+	fs.StringVar(&format, "format", "ics", "output format: `ics`, json or text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if startStr == "" || endStr == "" {
+		return fmt.Errorf("-start and -end are required")
+	}
+	start, err := parseEventTime(startStr)
+	if err != nil {
+		return fmt.Errorf("parsing -start: %w", err)
+	}
+	end, err := parseEventTime(endStr)
+	if err != nil {
+		return fmt.Errorf("parsing -end: %w", err)
+	}
+
+	intervals, err := computeFreeBusy(client, hclient, endpoint, calendars, start, end, cache)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "ics":
+		return writeFreeBusyICS(os.Stdout, start, end, intervals)
+	case "json":
+		return writeFreeBusyJSON(os.Stdout, start, end, intervals)
+	case "text":
+		return writeFreeBusyText(os.Stdout, intervals)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// computeFreeBusy walks the given calendars over start..end and returns the
+// merged busy intervals, derived from each event's TRANSP and STATUS. For
+// calendars whose server advertises the CALDAV:free-busy-query REPORT (see
+// freeBusyReportCapable), that's used directly; the rest fall back to
+// computing free/busy from the expanded events ourselves.
+func computeFreeBusy(client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, start, end time.Time, cache *cacheConfig) ([]fbInterval, error) {
+	ctx := context.Background()
+	var busy, tentative []fbInterval
+	var clientSide []caldav.Calendar
+	for _, c := range calendars {
+		ivs, ok, err := queryFreeBusyReport(ctx, hclient, endpoint, c.Path, start, end)
+		if err != nil {
+			log.Printf("free-busy-query REPORT for %v: %v; falling back to client-side computation", c.Name, err)
+			ok = false
+		}
+		if !ok {
+			clientSide = append(clientSide, c)
+			continue
+		}
+		for _, iv := range ivs {
+			if iv.fbtype == "BUSY-TENTATIVE" {
+				tentative = append(tentative, iv)
+			} else {
+				busy = append(busy, iv)
+			}
+		}
+	}
+
+	if len(clientSide) > 0 {
+		es, err := queryEvents(client, clientSide, start, end, false, cache)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			switch {
+			case e.status == string(ical.EventTentative):
+				tentative = append(tentative, fbInterval{e.start, e.end, "BUSY-TENTATIVE"})
+			case e.transparency == "TRANSPARENT":
+				// FREE: doesn't contribute to busy time.
+			default:
+				busy = append(busy, fbInterval{e.start, e.end, "BUSY"})
+			}
+		}
+	}
+
+	intervals := mergeIntervals(busy)
+	intervals = append(intervals, mergeIntervals(tentative)...)
+	slices.SortFunc(intervals, func(a, b fbInterval) int {
+		return a.start.Compare(b.start)
+	})
+	return intervals, nil
+}
+
+// freeBusyReportCapable reports whether calendarPath's DAV:supported-report-set
+// advertises the CALDAV:free-busy-query REPORT (RFC 4791 section 7.10).
+// go-webdav doesn't implement this REPORT (see the TODO in its
+// caldav/elements.go) or expose supported-report-set, so — as with getCTag
+// in cache.go — we issue the PROPFIND ourselves.
+func freeBusyReportCapable(ctx context.Context, hclient webdav.HTTPClient, endpoint *url.URL, calendarPath string) (bool, error) {
+	const body = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop><D:supported-report-set/></D:prop>
+</D:propfind>`
+
+	u := *endpoint
+	u.Path = calendarPath
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", u.String(), strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "0")
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("PROPFIND %v: %v", u.String(), resp.Status)
+	}
+
+	var ms struct {
+		Responses []struct {
+			Propstat []struct {
+				Prop struct {
+					SupportedReportSet struct {
+						SupportedReport []struct {
+							Report struct {
+								FreeBusyQuery *struct{} `xml:"free-busy-query"`
+							} `xml:"report"`
+						} `xml:"supported-report"`
+					} `xml:"supported-report-set"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return false, err
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			for _, sr := range ps.Prop.SupportedReportSet.SupportedReport {
+				if sr.Report.FreeBusyQuery != nil {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// queryFreeBusyReport issues a CALDAV:free-busy-query REPORT against
+// calendarPath and parses the returned VFREEBUSY into intervals. ok is false
+// (with a nil error) if the server doesn't advertise the REPORT, so the
+// caller can fall back to client-side computation without treating it as a
+// failure.
+func queryFreeBusyReport(ctx context.Context, hclient webdav.HTTPClient, endpoint *url.URL, calendarPath string, start, end time.Time) (intervals []fbInterval, ok bool, err error) {
+	capable, err := freeBusyReportCapable(ctx, hclient, endpoint, calendarPath)
+	if err != nil || !capable {
+		return nil, false, err
+	}
+
+	const layout = "20060102T150405Z"
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<C:free-busy-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <C:time-range start="%s" end="%s"/>
+</C:free-busy-query>`, start.UTC().Format(layout), end.UTC().Format(layout))
+
+	u := *endpoint
+	u.Path = calendarPath
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "REPORT", u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, true, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "0")
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, true, fmt.Errorf("REPORT %v: %v", u.String(), resp.Status)
+	}
+
+	cal, err := ical.NewDecoder(resp.Body).Decode()
+	if err != nil {
+		return nil, true, err
+	}
+	for _, comp := range cal.Children {
+		if comp.Name != ical.CompFreeBusy {
+			continue
+		}
+		for _, prop := range comp.Props.Values(ical.PropFreeBusy) {
+			fbtype := prop.Params.Get(ical.ParamFreeBusyType)
+			if fbtype == "" {
+				fbtype = "BUSY"
+			}
+			for _, period := range strings.Split(prop.Value, ",") {
+				iv, err := parsePeriod(period)
+				if err != nil {
+					log.Printf("parsing FREEBUSY period %q: %v", period, err)
+					continue
+				}
+				iv.fbtype = fbtype
+				intervals = append(intervals, iv)
+			}
+		}
+	}
+	return intervals, true, nil
+}
+
+// parsePeriod parses a PERIOD value (RFC 5545 section 3.3.9) in its
+// start/end form, e.g. "20060102T150405Z/20060102T160000Z". The
+// start/duration form isn't handled: servers responding to a
+// free-busy-query REPORT have start and end readily at hand and, in
+// practice, use it.
+func parsePeriod(s string) (fbInterval, error) {
+	const layout = "20060102T150405Z"
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return fbInterval{}, fmt.Errorf("expected start/end, got %q", s)
+	}
+	start, err := time.Parse(layout, parts[0])
+	if err != nil {
+		return fbInterval{}, err
+	}
+	end, err := time.Parse(layout, parts[1])
+	if err != nil {
+		return fbInterval{}, fmt.Errorf("period end %q isn't a start/duration form this client understands: %w", parts[1], err)
+	}
+	return fbInterval{start: start, end: end}, nil
+}
+
+// mergeIntervals sorts intervals by start time and merges the ones that
+// overlap or touch. All intervals are assumed to share the same fbtype.
+func mergeIntervals(intervals []fbInterval) []fbInterval {
+	if len(intervals) == 0 {
+		return nil
+	}
+	s := slices.Clone(intervals)
+	slices.SortFunc(s, func(a, b fbInterval) int {
+		return a.start.Compare(b.start)
+	})
+
+	merged := make([]fbInterval, 0, len(s))
+	cur := s[0]
+	for _, iv := range s[1:] {
+		if iv.start.After(cur.end) {
+			merged = append(merged, cur)
+			cur = iv
+			continue
+		}
+		if iv.end.After(cur.end) {
+			cur.end = iv.end
+		}
+	}
+	merged = append(merged, cur)
+	return merged
+}
+
+func writeFreeBusyICS(w io.Writer, start, end time.Time, intervals []fbInterval) error {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropProductID, "-//jech/ical//EN")
+	cal.Props.SetText(ical.PropVersion, "2.0")
+
+	fb := ical.NewComponent(ical.CompFreeBusy)
+	fb.Props.SetText(ical.PropUID, newUID())
+	fb.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	fb.Props.SetDateTime(ical.PropDateTimeStart, start)
+	fb.Props.SetDateTime(ical.PropDateTimeEnd, end)
+	for _, iv := range intervals {
+		prop := ical.NewProp(ical.PropFreeBusy)
+		if iv.fbtype != "BUSY" {
+			prop.Params.Set(ical.ParamFreeBusyType, iv.fbtype)
+		}
+		prop.Value = periodString(iv.start, iv.end)
+		fb.Props.Add(prop)
+	}
+	cal.Children = append(cal.Children, fb)
+
+	return ical.NewEncoder(w).Encode(cal)
+}
+
+func periodString(start, end time.Time) string {
+	const layout = "20060102T150405Z"
+	return start.UTC().Format(layout) + "/" + end.UTC().Format(layout)
+}
+
+func writeFreeBusyJSON(w io.Writer, start, end time.Time, intervals []fbInterval) error {
+	type period struct {
+		Start  time.Time `json:"start"`
+		End    time.Time `json:"end"`
+		FBType string    `json:"fbtype"`
+	}
+	out := struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Busy  []period  `json:"busy"`
+	}{Start: start, End: end}
+	for _, iv := range intervals {
+		out.Busy = append(out.Busy, period{iv.start, iv.end, iv.fbtype})
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeFreeBusyText(w io.Writer, intervals []fbInterval) error {
+	for _, iv := range intervals {
+		_, err := fmt.Fprintf(w, "%v  %v  %v\n",
+			iv.start.Format("Mon 2006-01-02 15:04"),
+			iv.end.Format("Mon 2006-01-02 15:04"),
+			iv.fbtype,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -16,16 +15,19 @@ import (
 	"time"
 
 	"github.com/emersion/go-ical"
-	"github.com/emersion/go-webdav"
 	"github.com/emersion/go-webdav/caldav"
-	rrule "github.com/teambition/rrule-go"
 )
 
 type config struct {
-	Endpoint  string   `json:"endpoint"`
-	Username  string   `json:"username,omitempty"`
-	Password  string   `json:"password,omitempty"`
-	Calendars []string `json:"calendars,omitempty"`
+	Endpoint  string     `json:"endpoint"`
+	Username  string     `json:"username,omitempty"`
+	Password  string     `json:"password,omitempty"`
+	Calendars []string   `json:"calendars,omitempty"`
+	Auth      authConfig `json:"auth,omitempty"`
+	// CacheDir, if set, enables a local on-disk mirror of calendar
+	// objects, keyed on each collection's CTag, so that repeated runs
+	// against an unchanged calendar don't touch the network at all.
+	CacheDir string `json:"cache_dir,omitempty"`
 }
 
 func main() {
@@ -46,6 +48,9 @@ func main() {
 	var durationStr string
 	flag.StringVar(&durationStr, "duration", "week",
 		"time interval of interest")
+	var serveAddr string
+	flag.StringVar(&serveAddr, "serve", "",
+		"serve a calendar dashboard on the given `address` (e.g. :8080) instead of printing events")
 	flag.Parse()
 
 	var duration time.Duration
@@ -76,40 +81,64 @@ func main() {
 		log.Fatalf("%v: no endpoint specified", configFile)
 	}
 
-	var hclient webdav.HTTPClient
-
-	if config.Username != "" {
-		hclient = webdav.HTTPClientWithBasicAuth(
-			hclient, config.Username, config.Password,
-		)
-	} else {
-		hclient = http.DefaultClient
+	tokenCacheFile := filepath.Join(filepath.Dir(configFile), "oauth2-token.json")
+	hclient, err := buildHTTPClient(config, tokenCacheFile)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 	client, err := caldav.NewClient(hclient, config.Endpoint)
 	if err != nil {
 		log.Fatalf("NewClient: %v", err)
 	}
 
-	var calendars []caldav.Calendar
-	if !listCalendars && len(config.Calendars) > 0 {
-		for _, pth := range config.Calendars {
-			calendars = append(calendars, caldav.Calendar{
-				Path: pth,
-			})
+	endpointURL, err := url.Parse(config.Endpoint)
+	if err != nil {
+		log.Fatalf("Cannot parse %v: %v", config.Endpoint, err)
+	}
+
+	var cache *cacheConfig
+	if config.CacheDir != "" {
+		cache = &cacheConfig{
+			dir:      config.CacheDir,
+			hclient:  hclient,
+			endpoint: endpointURL,
 		}
-	} else {
-		calendars, err = findCalendars(client)
+	}
+
+	if serveAddr != "" {
+		calendars, err := resolveCalendars(client, config, false)
 		if err != nil {
-			log.Fatalf("findCalendars: %v", err)
+			log.Fatalf("%v", err)
 		}
+		if err := runServer(serveAddr, client, hclient, endpointURL, config, calendars, cache); err != nil {
+			log.Fatalf("serve: %v", err)
+		}
+		return
 	}
 
-	if listCalendars {
-		u, err := url.Parse(config.Endpoint)
+	switch flag.Arg(0) {
+	case "add", "edit", "delete", "freebusy":
+		calendars, err := resolveCalendars(client, config, false)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		err = runCommand(
+			flag.Arg(0), client, hclient, endpointURL,
+			calendars, flag.Args()[1:], cache,
+		)
 		if err != nil {
-			log.Fatalf("Cannot parse %v: %v", config.Endpoint, err)
+			log.Fatalf("%v: %v", flag.Arg(0), err)
 		}
-		root := u.Path
+		return
+	}
+
+	calendars, err := resolveCalendars(client, config, listCalendars)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if listCalendars {
+		root := endpointURL.Path
 		for _, c := range calendars {
 			pth, err := filepath.Rel(root, c.Path)
 			if err != nil {
@@ -125,7 +154,7 @@ func main() {
 
 	start := time.Now()
 	end := time.Now().Add(duration)
-	es, err := queryEvents(client, calendars, start, end, verbose)
+	es, err := queryEvents(client, calendars, start, end, verbose, cache)
 	if err != nil {
 		log.Fatalf("queryEvents: %v", err)
 	}
@@ -151,6 +180,25 @@ func readConfig(filename string) (*config, error) {
 	return &c, nil
 }
 
+// resolveCalendars returns the calendars a command should operate on: the
+// ones listed in the config file, unless listCalendars is set (or the config
+// doesn't restrict to a subset), in which case all of the user's calendars
+// are discovered from the server.
+func resolveCalendars(client *caldav.Client, config *config, listCalendars bool) ([]caldav.Calendar, error) {
+	if !listCalendars && len(config.Calendars) > 0 {
+		calendars := make([]caldav.Calendar, len(config.Calendars))
+		for i, pth := range config.Calendars {
+			calendars[i] = caldav.Calendar{Path: pth}
+		}
+		return calendars, nil
+	}
+	calendars, err := findCalendars(client)
+	if err != nil {
+		return nil, fmt.Errorf("findCalendars: %w", err)
+	}
+	return calendars, nil
+}
+
 func findCalendars(client *caldav.Client) ([]caldav.Calendar, error) {
 	principal, err := client.FindCurrentUserPrincipal(context.Background())
 	if err != nil {
@@ -170,105 +218,194 @@ func findCalendars(client *caldav.Client) ([]caldav.Calendar, error) {
 type event struct {
 	start, end                     time.Time
 	summary, description, location string
+	status, transparency           string
+	uid                            string
 }
 
-func queryEvents(client *caldav.Client, calendars []caldav.Calendar, start, end time.Time, includeDescription bool) ([]event, error) {
-	props := []string{"SUMMARY", "DTSTART", "DTEND", "LOCATION"}
-	if includeDescription {
-		props = append(props, "DESCRIPTION")
-	}
-	query := caldav.CalendarQuery{
-		CompRequest: caldav.CalendarCompRequest{
-			Name: "VCALENDAR",
-			Comps: []caldav.CalendarCompRequest{{
-				Name:  "VEVENT",
-				Props: props,
-			}},
-		},
-		CompFilter: caldav.CompFilter{
-			Name: "VCALENDAR",
-			Comps: []caldav.CompFilter{{
-				Name:  "VEVENT",
-				Start: start,
-				End:   end,
-			}},
-		},
-	}
-
+func queryEvents(client *caldav.Client, calendars []caldav.Calendar, start, end time.Time, includeDescription bool, cache *cacheConfig) ([]event, error) {
 	es := make([]event, 0)
 
 	for _, c := range calendars {
-		objs, err := client.QueryCalendar(
-			context.Background(), c.Path, &query,
-		)
+		cals, err := calendarObjects(context.Background(), client, cache, c, start, end)
 		if err != nil {
-			log.Printf("QueryCalendar(%v): %v", c.Name, err)
+			log.Printf("calendarObjects(%v): %v", c.Name, err)
 			continue
 		}
-		for _, o := range objs {
-			for _, e := range o.Data.Events() {
-				e, err := parseEvent(
-					e, start, end, includeDescription,
-				)
-				if err != nil {
-					log.Println("parseEvent:", err)
-					continue
-				}
-				es = append(es, e...)
-			}
+		for _, cal := range cals {
+			es = append(es, expandEvents(
+				cal.Events(), start, end, includeDescription,
+			)...)
 		}
 	}
 
+	// calendarObjects may return objects straight from the local cache,
+	// without the server-side time-range filter a direct calendar-query
+	// would have applied, so filter (again, harmlessly, for the
+	// uncached path) by the requested window here.
+	es = slices.DeleteFunc(es, func(e event) bool {
+		return !e.start.Before(end) || !e.end.After(start)
+	})
+
 	slices.SortFunc(es, func(a, b event) int {
 		return a.start.Compare(b.start)
 	})
 	return es, nil
 }
 
-func parseEvent(e ical.Event, start, end time.Time, includeDescription bool) ([]event, error) {
-	dtstart, _ := e.DateTimeStart(time.Local)
-	dtend, _ := e.DateTimeEnd(time.Local)
+// eventGroup holds the master VEVENT for a UID together with any per-instance
+// overrides (separate VEVENTs carrying a RECURRENCE-ID), keyed by the
+// occurrence they override.
+type eventGroup struct {
+	master    *ical.Event
+	overrides map[time.Time]ical.Event
+}
+
+// expandEvents groups the VEVENTs of a single calendar object by UID, then
+// expands each group's recurrence (if any) into a list of occurrences,
+// applying RECURRENCE-ID overrides and dropping cancelled instances.
+func expandEvents(evs []ical.Event, start, end time.Time, includeDescription bool) []event {
+	groups := make(map[string]*eventGroup)
+	var order []string
+	for _, e := range evs {
+		uid, _ := e.Props.Text(ical.PropUID)
+		g := groups[uid]
+		if g == nil {
+			g = &eventGroup{overrides: make(map[time.Time]ical.Event)}
+			groups[uid] = g
+			order = append(order, uid)
+		}
+		if e.Props.Get(ical.PropRecurrenceID) == nil {
+			ee := e
+			g.master = &ee
+			continue
+		}
+		rid, err := e.Props.DateTime(ical.PropRecurrenceID, time.Local)
+		if err != nil {
+			log.Println("parseEvent: RECURRENCE-ID:", err)
+			continue
+		}
+		g.overrides[rid.UTC()] = e
+	}
+
+	es := make([]event, 0, len(evs))
+	for _, uid := range order {
+		es = append(es, expandGroup(
+			uid, groups[uid], start, end, includeDescription,
+		)...)
+	}
+	return es
+}
+
+func expandGroup(uid string, g *eventGroup, start, end time.Time, includeDescription bool) []event {
+	if g.master == nil {
+		// An override with no matching master: the server sent us an
+		// orphaned RECURRENCE-ID VEVENT. Treat it as a standalone event
+		// rather than silently dropping it.
+		es := make([]event, 0, len(g.overrides))
+		for _, o := range g.overrides {
+			if status, _ := o.Status(); status == ical.EventCancelled {
+				continue
+			}
+			if e, ok := eventFromComponent(o, includeDescription); ok {
+				es = append(es, e)
+			}
+		}
+		return es
+	}
+
+	master := g.master
+	status, _ := master.Status()
+	if status == ical.EventCancelled {
+		return nil
+	}
+
+	ropt, err := master.Props.RecurrenceRule()
+	if err != nil {
+		log.Println("parseEvent:", err)
+		return nil
+	}
+	if ropt == nil {
+		if e, ok := eventFromComponent(*master, includeDescription); ok {
+			return []event{e}
+		}
+		return nil
+	}
+
+	set, err := master.RecurrenceSet(time.Local)
+	if err != nil {
+		log.Println("parseEvent:", err)
+		return nil
+	}
+
+	dtstart, _ := master.DateTimeStart(time.Local)
+	dtend, _ := master.DateTimeEnd(time.Local)
 	duration := dtend.Sub(dtstart)
-	ropt, _ := e.Props.RecurrenceRule()
-	summary, _ := e.Props.Text(ical.PropSummary)
+	summary, _ := master.Props.Text(ical.PropSummary)
 	var description string
 	if includeDescription {
-		description, _ = e.Props.Text(
-			ical.PropDescription,
-		)
+		description, _ = master.Props.Text(ical.PropDescription)
 	}
-	location, _ := e.Props.Text(
-		ical.PropLocation,
-	)
-	if ropt != nil {
-		ropt.Dtstart = dtstart
-		rr, err := rrule.NewRRule(*ropt)
-		if err != nil {
-			return nil, err
-		}
-		ts := rr.Between(start, end, true)
-		es := make([]event, 0, len(ts))
-		for _, t := range ts {
-			tend := t.Add(duration)
-			ee := event{
-				start:       t,
-				end:         tend,
-				summary:     summary,
-				description: description,
-				location:    location,
+	location, _ := master.Props.Text(ical.PropLocation)
+	transparency, _ := master.Props.Text(ical.PropTransparency)
+
+	ts := set.Between(start, end, true)
+	es := make([]event, 0, len(ts))
+	for _, t := range ts {
+		if o, ok := g.overrides[t.UTC()]; ok {
+			if status, _ := o.Status(); status == ical.EventCancelled {
+				continue
+			}
+			if e, ok := eventFromComponent(o, includeDescription); ok {
+				es = append(es, e)
 			}
-			es = append(es, ee)
+			continue
 		}
-		return es, nil
+		es = append(es, event{
+			start:        t,
+			end:          t.Add(duration),
+			summary:      summary,
+			description:  description,
+			location:     location,
+			status:       string(status),
+			transparency: transparency,
+			uid:          uid,
+		})
+	}
+	return es
+}
+
+// eventFromComponent builds an event from a VEVENT's own properties, used
+// both for non-recurring masters and for RECURRENCE-ID overrides.
+func eventFromComponent(e ical.Event, includeDescription bool) (event, bool) {
+	dtstart, err := e.DateTimeStart(time.Local)
+	if err != nil {
+		log.Println("parseEvent:", err)
+		return event{}, false
 	}
-	ee := event{
-		start:       dtstart,
-		end:         dtend,
-		summary:     summary,
-		description: description,
-		location:    location,
+	dtend, err := e.DateTimeEnd(time.Local)
+	if err != nil {
+		log.Println("parseEvent:", err)
+		return event{}, false
+	}
+	summary, _ := e.Props.Text(ical.PropSummary)
+	var description string
+	if includeDescription {
+		description, _ = e.Props.Text(ical.PropDescription)
 	}
-	return []event{ee}, nil
+	location, _ := e.Props.Text(ical.PropLocation)
+	status, _ := e.Status()
+	transparency, _ := e.Props.Text(ical.PropTransparency)
+	uid, _ := e.Props.Text(ical.PropUID)
+	return event{
+		start:        dtstart,
+		end:          dtend,
+		summary:      summary,
+		description:  description,
+		location:     location,
+		status:       string(status),
+		transparency: transparency,
+		uid:          uid,
+	}, true
 }
 
 func printEvent(w io.Writer, e event, verbose bool) error {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+func parseEvents(t *testing.T, ics string) []ical.Event {
+	t.Helper()
+	cal, err := ical.NewDecoder(strings.NewReader(ics)).Decode()
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return cal.Events()
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse("20060102T150405Z", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+const weeklySeries = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//jech/ical//EN
+BEGIN:VEVENT
+UID:weekly1
+DTSTART:20260105T090000Z
+DTEND:20260105T100000Z
+SUMMARY:Standup
+RRULE:FREQ=WEEKLY;COUNT=4
+EXDATE:20260112T090000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly1
+RECURRENCE-ID:20260119T090000Z
+DTSTART:20260119T103000Z
+DTEND:20260119T113000Z
+SUMMARY:Standup (moved)
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly1
+RECURRENCE-ID:20260126T090000Z
+DTSTART:20260126T090000Z
+DTEND:20260126T100000Z
+SUMMARY:Standup
+STATUS:CANCELLED
+END:VEVENT
+END:VCALENDAR
+`
+
+// TestExpandGroupEXDATEOverrideCancelled checks that expandGroup drops the
+// EXDATE'd occurrence, applies the RECURRENCE-ID override's own time and
+// summary, and drops an occurrence cancelled via its override.
+func TestExpandGroupEXDATEOverrideCancelled(t *testing.T) {
+	evs := parseEvents(t, weeklySeries)
+	es := expandEvents(evs, date("20260101T000000Z"), date("20260201T000000Z"), false)
+
+	if len(es) != 2 {
+		t.Fatalf("expandEvents() returned %v events, want 2: %+v", len(es), es)
+	}
+
+	first, second := es[0], es[1]
+	if !first.start.Equal(date("20260105T090000Z")) || first.summary != "Standup" {
+		t.Errorf("first occurrence = %+v, want unmodified 2026-01-05 Standup", first)
+	}
+	if !second.start.Equal(date("20260119T103000Z")) || second.summary != "Standup (moved)" {
+		t.Errorf("second occurrence = %+v, want overridden 2026-01-19T10:30 Standup (moved)", second)
+	}
+	for _, e := range es {
+		if e.start.Equal(date("20260112T090000Z")) {
+			t.Errorf("EXDATE'd occurrence was not excluded: %+v", e)
+		}
+		if e.start.Equal(date("20260126T090000Z")) || e.start.Equal(date("20260126T103000Z")) {
+			t.Errorf("occurrence cancelled via override was not excluded: %+v", e)
+		}
+	}
+}
+
+const cancelledMaster = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//jech/ical//EN
+BEGIN:VEVENT
+UID:cancelled1
+DTSTART:20260105T090000Z
+DTEND:20260105T100000Z
+SUMMARY:Standup
+RRULE:FREQ=WEEKLY;COUNT=4
+STATUS:CANCELLED
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestExpandGroupCancelledMaster(t *testing.T) {
+	evs := parseEvents(t, cancelledMaster)
+	es := expandEvents(evs, date("20260101T000000Z"), date("20260201T000000Z"), false)
+	if len(es) != 0 {
+		t.Fatalf("expandEvents() = %+v, want no events for a cancelled master", es)
+	}
+}
+
+const orphanedOverride = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//jech/ical//EN
+BEGIN:VEVENT
+UID:orphan1
+RECURRENCE-ID:20260105T090000Z
+DTSTART:20260105T090000Z
+DTEND:20260105T100000Z
+SUMMARY:Standup
+END:VEVENT
+END:VCALENDAR
+`
+
+// TestExpandGroupOrphanedOverride checks that a RECURRENCE-ID VEVENT whose
+// master never arrived is still surfaced, not silently dropped.
+func TestExpandGroupOrphanedOverride(t *testing.T) {
+	evs := parseEvents(t, orphanedOverride)
+	es := expandEvents(evs, date("20260101T000000Z"), date("20260201T000000Z"), false)
+	if len(es) != 1 || es[0].summary != "Standup" {
+		t.Fatalf("expandEvents() = %+v, want the orphaned override as a standalone event", es)
+	}
+}
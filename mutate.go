@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	rrule "github.com/teambition/rrule-go"
+)
+
+// runCommand dispatches to the add, edit, delete and freebusy subcommands.
+func runCommand(cmd string, client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, args []string, cache *cacheConfig) error {
+	switch cmd {
+	case "add":
+		return cmdAdd(hclient, endpoint, calendars, args)
+	case "edit":
+		return cmdEdit(client, hclient, endpoint, calendars, args)
+	case "delete":
+		return cmdDelete(client, hclient, endpoint, calendars, args)
+	case "freebusy":
+		return cmdFreeBusy(client, hclient, endpoint, calendars, args, cache)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// eventFlags are the flags shared by the add and edit subcommands.
+type eventFlags struct {
+	calendar    string
+	summary     string
+	start       string
+	end         string
+	duration    string
+	location    string
+	description string
+	rrule       string
+}
+
+func (f *eventFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.calendar, "calendar", "", "calendar to operate on")
+	fs.StringVar(&f.summary, "summary", "", "event summary")
+	fs.StringVar(&f.start, "start", "", "event start time")
+	fs.StringVar(&f.end, "end", "", "event end time")
+	fs.StringVar(&f.duration, "duration", "", "event duration, as a Go duration (e.g. 1h30m)")
+	fs.StringVar(&f.location, "location", "", "event location")
+	fs.StringVar(&f.description, "description", "", "event description")
+	fs.StringVar(&f.rrule, "rrule", "", "recurrence rule (e.g. FREQ=WEEKLY;COUNT=5)")
+}
+
+func cmdAdd(hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	var f eventFlags
+	f.register(fs)
+	var stdin bool
+	fs.BoolVar(&stdin, "stdin", false, "read a full VEVENT from standard input")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cal, err := findCalendar(calendars, f.calendar)
+	if err != nil {
+		return err
+	}
+
+	var vevent *ical.Calendar
+	if stdin {
+		vevent, err = ical.NewDecoder(os.Stdin).Decode()
+		if err != nil {
+			return fmt.Errorf("decoding event from stdin: %w", err)
+		}
+		if len(vevent.Events()) != 1 {
+			return fmt.Errorf("expected exactly one VEVENT on stdin, got %v", len(vevent.Events()))
+		}
+		ev := vevent.Events()[0]
+		if ev.Props.Get(ical.PropUID) == nil {
+			ev.Props.SetText(ical.PropUID, newUID())
+		}
+		ev.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	} else {
+		if f.summary == "" || f.start == "" {
+			return fmt.Errorf("-summary and -start are required (or use -stdin)")
+		}
+		ev, err := buildEvent(f, newUID())
+		if err != nil {
+			return err
+		}
+		vevent = ical.NewCalendar()
+		vevent.Props.SetText(ical.PropProductID, "-//jech/ical//EN")
+		vevent.Props.SetText(ical.PropVersion, "2.0")
+		vevent.Children = append(vevent.Children, ev.Component)
+	}
+
+	uid, err := vevent.Events()[0].Props.Text(ical.PropUID)
+	if err != nil {
+		return err
+	}
+	path := path.Join(cal.Path, uid+".ics")
+
+	// PutCalendarObject doesn't support conditional requests yet, so we
+	// issue the PUT ourselves with If-None-Match to reject accidental
+	// overwrites of an existing object.
+	co, err := putCalendarObject(
+		context.Background(), hclient, endpoint, path, vevent,
+		"", webdav.ConditionalMatch("*"),
+	)
+	if err != nil {
+		return fmt.Errorf("PUT %v: %w", path, err)
+	}
+	fmt.Printf("added %v (etag %v)\n", co.Path, co.ETag)
+	return nil
+}
+
+func cmdEdit(client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	var f eventFlags
+	f.register(fs)
+	var uid string
+	fs.StringVar(&uid, "uid", "", "UID of the event to edit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if uid == "" {
+		return fmt.Errorf("-uid is required")
+	}
+
+	cal, err := findCalendar(calendars, f.calendar)
+	if err != nil {
+		return err
+	}
+
+	co, err := findObjectByUID(client, cal, uid)
+	if err != nil {
+		return err
+	}
+
+	events := co.Data.Events()
+	i := masterEventIndex(events)
+	if i < 0 {
+		return fmt.Errorf("event %v: no master VEVENT found", uid)
+	}
+	ev := events[i]
+
+	if f.summary != "" {
+		ev.Props.SetText(ical.PropSummary, f.summary)
+	}
+	if f.location != "" {
+		ev.Props.SetText(ical.PropLocation, f.location)
+	}
+	if f.description != "" {
+		ev.Props.SetText(ical.PropDescription, f.description)
+	}
+	if f.start != "" || f.end != "" || f.duration != "" {
+		if err := applyTimes(ev, f); err != nil {
+			return err
+		}
+	}
+	if f.rrule != "" {
+		ropt, err := rrule.StrToROption(f.rrule)
+		if err != nil {
+			return fmt.Errorf("parsing -rrule: %w", err)
+		}
+		ev.Props.SetRecurrenceRule(ropt)
+	}
+	ev.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+
+	match := webdav.ConditionalMatch("*")
+	if co.ETag != "" {
+		match = webdav.ConditionalMatch(strconv.Quote(co.ETag))
+	}
+	newCo, err := putCalendarObject(
+		context.Background(), hclient, endpoint, co.Path, co.Data,
+		match, "",
+	)
+	if err != nil {
+		return fmt.Errorf("PUT %v: %w", co.Path, err)
+	}
+	fmt.Printf("edited %v (etag %v)\n", newCo.Path, newCo.ETag)
+	return nil
+}
+
+func cmdDelete(client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, calendars []caldav.Calendar, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	var calendar, uid string
+	fs.StringVar(&calendar, "calendar", "", "calendar to operate on")
+	fs.StringVar(&uid, "uid", "", "UID of the event to delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if uid == "" {
+		return fmt.Errorf("-uid is required")
+	}
+
+	cal, err := findCalendar(calendars, calendar)
+	if err != nil {
+		return err
+	}
+
+	co, err := findObjectByUID(client, cal, uid)
+	if err != nil {
+		return err
+	}
+
+	match := webdav.ConditionalMatch("")
+	if co.ETag != "" {
+		match = webdav.ConditionalMatch(strconv.Quote(co.ETag))
+	}
+	if err := deleteObject(context.Background(), hclient, endpoint, co.Path, match); err != nil {
+		return fmt.Errorf("DELETE %v: %w", co.Path, err)
+	}
+	fmt.Printf("deleted %v\n", co.Path)
+	return nil
+}
+
+// findCalendar resolves a --calendar argument (a path relative to the
+// endpoint, or a calendar name) to one of the configured calendars. If name
+// is empty and there is exactly one calendar to choose from, that one is
+// used.
+func findCalendar(calendars []caldav.Calendar, name string) (caldav.Calendar, error) {
+	if name == "" {
+		if len(calendars) == 1 {
+			return calendars[0], nil
+		}
+		return caldav.Calendar{}, fmt.Errorf("-calendar is required when more than one calendar is configured")
+	}
+	for _, c := range calendars {
+		if c.Path == name || c.Name == name {
+			return c, nil
+		}
+	}
+	return caldav.Calendar{}, fmt.Errorf("unknown calendar %q", name)
+}
+
+// findObjectByUID fetches the calendar object containing the VEVENT with the
+// given UID. The client doesn't expose a way to filter calendar-query REPORTs
+// by property value, so we query every VEVENT in the calendar and filter on
+// the client side.
+func findObjectByUID(client *caldav.Client, cal caldav.Calendar, uid string) (*caldav.CalendarObject, error) {
+	query := caldav.CalendarQuery{
+		CompRequest: caldav.CalendarCompRequest{
+			Name: "VCALENDAR",
+			Comps: []caldav.CalendarCompRequest{{
+				Name:     "VEVENT",
+				AllProps: true,
+			}},
+		},
+		CompFilter: caldav.CompFilter{
+			Name: "VCALENDAR",
+			Comps: []caldav.CompFilter{{
+				Name: "VEVENT",
+			}},
+		},
+	}
+	objs, err := client.QueryCalendar(context.Background(), cal.Path, &query)
+	if err != nil {
+		return nil, fmt.Errorf("QueryCalendar: %w", err)
+	}
+	for _, o := range objs {
+		for _, e := range o.Data.Events() {
+			u, _ := e.Props.Text(ical.PropUID)
+			if u == uid {
+				return &o, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no event with UID %v in %v", uid, cal.Path)
+}
+
+// masterEventIndex returns the index of the master VEVENT (the one without a
+// RECURRENCE-ID) among events, or -1 if there is none.
+func masterEventIndex(events []ical.Event) int {
+	for i, e := range events {
+		if e.Props.Get(ical.PropRecurrenceID) == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func applyTimes(ev ical.Event, f eventFlags) error {
+	var start, end time.Time
+	var err error
+	if f.start != "" {
+		start, err = parseEventTime(f.start)
+		if err != nil {
+			return fmt.Errorf("parsing -start: %w", err)
+		}
+		ev.Props.SetDateTime(ical.PropDateTimeStart, start)
+	} else {
+		start, err = ev.DateTimeStart(time.Local)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case f.end != "":
+		end, err = parseEventTime(f.end)
+		if err != nil {
+			return fmt.Errorf("parsing -end: %w", err)
+		}
+		ev.Props.SetDateTime(ical.PropDateTimeEnd, end)
+	case f.duration != "":
+		d, err := time.ParseDuration(f.duration)
+		if err != nil {
+			return fmt.Errorf("parsing -duration: %w", err)
+		}
+		ev.Props.SetDateTime(ical.PropDateTimeEnd, start.Add(d))
+	}
+	return nil
+}
+
+func buildEvent(f eventFlags, uid string) (*ical.Event, error) {
+	start, err := parseEventTime(f.start)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -start: %w", err)
+	}
+
+	var end time.Time
+	switch {
+	case f.end != "":
+		end, err = parseEventTime(f.end)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -end: %w", err)
+		}
+	case f.duration != "":
+		d, err := time.ParseDuration(f.duration)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -duration: %w", err)
+		}
+		end = start.Add(d)
+	default:
+		end = start.Add(time.Hour)
+	}
+
+	ev := ical.NewEvent()
+	ev.Props.SetText(ical.PropUID, uid)
+	ev.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	ev.Props.SetDateTime(ical.PropDateTimeStart, start)
+	ev.Props.SetDateTime(ical.PropDateTimeEnd, end)
+	ev.Props.SetText(ical.PropSummary, f.summary)
+	if f.location != "" {
+		ev.Props.SetText(ical.PropLocation, f.location)
+	}
+	if f.description != "" {
+		ev.Props.SetText(ical.PropDescription, f.description)
+	}
+	if f.rrule != "" {
+		ropt, err := rrule.StrToROption(f.rrule)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -rrule: %w", err)
+		}
+		ev.Props.SetRecurrenceRule(ropt)
+	}
+	return ev, nil
+}
+
+// parseEventTime parses a command-line time argument, accepting a bare date
+// (an all-day event), a local date and time, or a full RFC 3339 timestamp.
+func parseEventTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// newUID generates a UID suitable for a new VEVENT, as recommended by
+// RFC 5545 section 3.8.4.7.
+func newUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x@jech-ical", b)
+}
+
+// putCalendarObject PUTs cal to path, optionally setting If-Match or
+// If-None-Match so that the server rejects the write on a conflicting
+// change. caldav.Client.PutCalendarObject doesn't support conditional
+// requests, so the request is built and sent by hand.
+func putCalendarObject(ctx context.Context, hclient webdav.HTTPClient, endpoint *url.URL, path string, cal *ical.Calendar, ifMatch, ifNoneMatch webdav.ConditionalMatch) (*caldav.CalendarObject, error) {
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return nil, err
+	}
+
+	u := *endpoint
+	u.Path = path
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ical.MIMEType)
+	if ifMatch.IsSet() {
+		req.Header.Set("If-Match", string(ifMatch))
+	}
+	if ifNoneMatch.IsSet() {
+		req.Header.Set("If-None-Match", string(ifNoneMatch))
+	}
+
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("precondition failed: object was modified concurrently")
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%v: %s", resp.Status, body)
+	}
+
+	co := &caldav.CalendarObject{Path: path}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		if unquoted, err := strconv.Unquote(etag); err == nil {
+			co.ETag = unquoted
+		} else {
+			co.ETag = etag
+		}
+	}
+	return co, nil
+}
+
+// deleteObject issues a DELETE for path, optionally setting If-Match so that
+// the server rejects the deletion on a conflicting change.
+func deleteObject(ctx context.Context, hclient webdav.HTTPClient, endpoint *url.URL, path string, ifMatch webdav.ConditionalMatch) error {
+	u := *endpoint
+	u.Path = path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if ifMatch.IsSet() {
+		req.Header.Set("If-Match", string(ifMatch))
+	}
+
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("precondition failed: object was modified concurrently")
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// mutateBackend is a minimal in-memory caldav.Backend, just enough to serve
+// the calendar-query REPORT findObjectByUID issues. PUT and DELETE never
+// reach it: newMutateTestServer intercepts those at the HTTP layer instead,
+// mirroring how mutate.go bypasses the client library for those methods to
+// get at conditional headers the library doesn't expose.
+type mutateBackend struct {
+	mu      sync.Mutex
+	objects map[string]caldav.CalendarObject
+}
+
+func (b *mutateBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return "/calendars/", nil
+}
+func (b *mutateBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return "/principal/", nil
+}
+func (b *mutateBackend) CreateCalendar(ctx context.Context, calendar *caldav.Calendar) error {
+	return fmt.Errorf("not supported")
+}
+func (b *mutateBackend) ListCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	return []caldav.Calendar{{Path: "/calendars/test/"}}, nil
+}
+func (b *mutateBackend) GetCalendar(ctx context.Context, path string) (*caldav.Calendar, error) {
+	return &caldav.Calendar{Path: path}, nil
+}
+func (b *mutateBackend) GetCalendarObject(ctx context.Context, path string, req *caldav.CalendarCompRequest) (*caldav.CalendarObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("no calendar object at %v", path)
+	}
+	return &o, nil
+}
+func (b *mutateBackend) ListCalendarObjects(ctx context.Context, path string, req *caldav.CalendarCompRequest) ([]caldav.CalendarObject, error) {
+	return b.QueryCalendarObjects(ctx, path, nil)
+}
+func (b *mutateBackend) QueryCalendarObjects(ctx context.Context, path string, query *caldav.CalendarQuery) ([]caldav.CalendarObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	objs := make([]caldav.CalendarObject, 0, len(b.objects))
+	for _, o := range b.objects {
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+func (b *mutateBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (*caldav.CalendarObject, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (b *mutateBackend) DeleteCalendarObject(ctx context.Context, path string) error {
+	return fmt.Errorf("not supported")
+}
+
+// newMutateTestServer serves PUT and DELETE itself, honoring If-Match and
+// If-None-Match against an in-memory ETag, since go-webdav's Handler doesn't
+// forward conditional headers for DELETE and its Client doesn't let callers
+// set them for PUT (see putCalendarObject and deleteObject in mutate.go).
+// Everything else is delegated to a real caldav.Handler over backend.
+func newMutateTestServer(t *testing.T, backend *mutateBackend) *httptest.Server {
+	t.Helper()
+	h := &caldav.Handler{Backend: backend}
+	var seq int
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			backend.mu.Lock()
+			defer backend.mu.Unlock()
+			existing, exists := backend.objects[r.URL.Path]
+
+			if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch == "*" && exists {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				unquoted, _ := strconv.Unquote(ifMatch)
+				if !exists || existing.ETag != unquoted {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+			}
+
+			data, err := ical.NewDecoder(r.Body).Decode()
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			seq++
+			etag := strconv.Itoa(seq)
+			backend.objects[r.URL.Path] = caldav.CalendarObject{Path: r.URL.Path, ETag: etag, Data: data}
+			w.Header().Set("ETag", strconv.Quote(etag))
+			if exists {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+			return
+		case http.MethodDelete:
+			backend.mu.Lock()
+			defer backend.mu.Unlock()
+			existing, exists := backend.objects[r.URL.Path]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				unquoted, _ := strconv.Unquote(ifMatch)
+				if existing.ETag != unquoted {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+			}
+			delete(backend.objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+func testCalendars() []caldav.Calendar {
+	return []caldav.Calendar{{Path: "/calendars/test/", Name: "test"}}
+}
+
+func mutateSummary(t *testing.T, backend *mutateBackend, uid string) string {
+	t.Helper()
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	for _, o := range backend.objects {
+		for _, e := range o.Data.Events() {
+			u, _ := e.Props.Text(ical.PropUID)
+			if u == uid {
+				s, _ := e.Props.Text(ical.PropSummary)
+				return s
+			}
+		}
+	}
+	t.Fatalf("no event with UID %v in backend", uid)
+	return ""
+}
+
+// TestCmdAddCreatesObject checks that add PUTs a new object and that a
+// second add with the same UID is rejected, since its If-None-Match: * would
+// otherwise silently overwrite an existing event.
+func TestCmdAddCreatesObject(t *testing.T) {
+	backend := &mutateBackend{objects: make(map[string]caldav.CalendarObject)}
+	srv := newMutateTestServer(t, backend)
+	defer srv.Close()
+	endpoint, _ := url.Parse(srv.URL)
+
+	stdin := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//jech/ical//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:ev1\r\nDTSTAMP:20260101T000000Z\r\n" +
+		"DTSTART:20260105T090000Z\r\nDTEND:20260105T100000Z\r\nSUMMARY:Standup\r\n" +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+	restoreStdin := swapStdin(t, stdin)
+	if err := cmdAdd(srv.Client(), endpoint, testCalendars(), []string{"-calendar=/calendars/test/", "-stdin"}); err != nil {
+		t.Fatalf("cmdAdd: %v", err)
+	}
+	restoreStdin()
+
+	if got := mutateSummary(t, backend, "ev1"); got != "Standup" {
+		t.Fatalf("summary = %q, want %q", got, "Standup")
+	}
+
+	restoreStdin = swapStdin(t, stdin)
+	err := cmdAdd(srv.Client(), endpoint, testCalendars(), []string{"-calendar=/calendars/test/", "-stdin"})
+	restoreStdin()
+	if err == nil {
+		t.Fatal("cmdAdd() = nil error on a duplicate UID, want a precondition failure")
+	}
+}
+
+// TestCmdEditUpdatesEvent checks that edit finds the event by UID and PUTs a
+// modified copy back, conditioned on the ETag it just read.
+func TestCmdEditUpdatesEvent(t *testing.T) {
+	obj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "1", Data: testEventCalendar("ev1", "Standup")}
+	backend := &mutateBackend{objects: map[string]caldav.CalendarObject{obj.Path: obj}}
+	srv := newMutateTestServer(t, backend)
+	defer srv.Close()
+	endpoint, _ := url.Parse(srv.URL)
+
+	client, err := caldav.NewClient(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := cmdEdit(client, srv.Client(), endpoint, testCalendars(), []string{"-uid=ev1", "-summary=Standup (moved)"}); err != nil {
+		t.Fatalf("cmdEdit: %v", err)
+	}
+
+	if got := mutateSummary(t, backend, "ev1"); got != "Standup (moved)" {
+		t.Fatalf("summary = %q, want %q", got, "Standup (moved)")
+	}
+}
+
+// TestCmdDeleteRemovesEvent checks that delete finds the event by UID and
+// issues a conditional DELETE.
+func TestCmdDeleteRemovesEvent(t *testing.T) {
+	obj := caldav.CalendarObject{Path: "/calendars/test/ev1.ics", ETag: "1", Data: testEventCalendar("ev1", "Standup")}
+	backend := &mutateBackend{objects: map[string]caldav.CalendarObject{obj.Path: obj}}
+	srv := newMutateTestServer(t, backend)
+	defer srv.Close()
+	endpoint, _ := url.Parse(srv.URL)
+
+	client, err := caldav.NewClient(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := cmdDelete(client, srv.Client(), endpoint, testCalendars(), []string{"-uid=ev1"}); err != nil {
+		t.Fatalf("cmdDelete: %v", err)
+	}
+
+	backend.mu.Lock()
+	_, exists := backend.objects[obj.Path]
+	backend.mu.Unlock()
+	if exists {
+		t.Fatal("event still present in backend after cmdDelete")
+	}
+}
+
+// TestCmdDeleteUnknownUID checks that deleting a UID that doesn't exist
+// surfaces an error instead of silently succeeding.
+func TestCmdDeleteUnknownUID(t *testing.T) {
+	backend := &mutateBackend{objects: make(map[string]caldav.CalendarObject)}
+	srv := newMutateTestServer(t, backend)
+	defer srv.Close()
+	endpoint, _ := url.Parse(srv.URL)
+
+	client, err := caldav.NewClient(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	err = cmdDelete(client, srv.Client(), endpoint, testCalendars(), []string{"-uid=nosuch"})
+	if err == nil {
+		t.Fatal("cmdDelete() = nil error for an unknown UID, want an error")
+	}
+}
+
+// swapStdin replaces os.Stdin with a pipe fed the given content, for
+// exercising cmdAdd's -stdin path, and returns a func to restore it.
+func swapStdin(t *testing.T, content string) func() {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	orig := os.Stdin
+	os.Stdin = r
+	go func() {
+		io.Copy(w, strings.NewReader(content))
+		w.Close()
+	}()
+	return func() { os.Stdin = orig }
+}
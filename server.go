@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// runServer starts an HTTP server exposing a month/week/agenda view of
+// calendars, plus a few iCalendar subscription endpoints. It only returns on
+// error: the server runs until the process is killed.
+func runServer(addr string, client *caldav.Client, hclient webdav.HTTPClient, endpoint *url.URL, config *config, calendars []caldav.Calendar, cache *cacheConfig) error {
+	s := &server{
+		client:    client,
+		hclient:   hclient,
+		endpoint:  endpoint,
+		config:    config,
+		calendars: calendars,
+		cache:     cache,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/month", s.handleMonth)
+	mux.HandleFunc("/week", s.handleWeek)
+	mux.HandleFunc("/agenda", s.handleAgenda)
+	mux.HandleFunc("/event/", s.handleEvent)
+	mux.HandleFunc("/calendar.ics", func(w http.ResponseWriter, r *http.Request) {
+		s.handleCalendarICS(w, r, "")
+	})
+	mux.HandleFunc("/freebusy.ifb", s.handleFreeBusy)
+	// Catch-all: "/" itself, and "/{calendar}/calendar.ics" subscription
+	// URLs, which we can't express as a ServeMux pattern without Go 1.22's
+	// wildcard routing.
+	mux.HandleFunc("/", s.handleRoot)
+
+	log.Printf("serving on %v", addr)
+	return http.ListenAndServe(addr, s.withBasicAuth(mux))
+}
+
+type server struct {
+	client    *caldav.Client
+	hclient   webdav.HTTPClient
+	endpoint  *url.URL
+	config    *config
+	calendars []caldav.Calendar
+	cache     *cacheConfig
+}
+
+// withBasicAuth guards h with the config's username/password, if any are
+// set.
+func (s *server) withBasicAuth(h http.Handler) http.Handler {
+	if s.config.Username == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.Password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ical"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"time": func(layout string, t time.Time) string { return t.Format(layout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p><a href="/agenda">agenda</a> | <a href="/week">week</a> | <a href="/month">month</a></p>
+<table border="1" cellpadding="4">
+<tr><th>Start</th><th>End</th><th>Summary</th><th>Location</th></tr>
+{{range .Events}}<tr>
+<td>{{time "Mon 2006-01-02 15:04" .Start}}</td>
+<td>{{time "Mon 2006-01-02 15:04" .End}}</td>
+<td><a href="/event/{{.ID}}">{{.Summary}}</a></td>
+<td>{{.Location}}</td>
+</tr>
+{{else}}<tr><td colspan="4">No events</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+var eventTemplate = template.Must(template.New("event").Funcs(template.FuncMap{
+	"time": func(layout string, t time.Time) string { return t.Format(layout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Summary}}</title></head>
+<body>
+<h1>{{.Summary}}</h1>
+<p>{{time "Mon 2006-01-02 15:04" .Start}} &ndash; {{time "Mon 2006-01-02 15:04" .End}}</p>
+{{if .Location}}<p>Location: {{.Location}}</p>{{end}}
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+<p><a href="/agenda">back to agenda</a></p>
+</body>
+</html>
+`))
+
+type templateEvent struct {
+	Start, End  time.Time
+	Summary     string
+	Location    string
+	Description string
+	UID         string
+	// ID identifies this specific occurrence, not just the series it
+	// belongs to: a recurring VEVENT's UID is shared by every occurrence,
+	// so the event link needs something finer-grained to point at.
+	ID string
+}
+
+func toTemplateEvents(es []event) []templateEvent {
+	tes := make([]templateEvent, len(es))
+	for i, e := range es {
+		tes[i] = templateEvent{
+			Start:       e.start,
+			End:         e.end,
+			Summary:     e.summary,
+			Location:    e.location,
+			Description: e.description,
+			UID:         e.uid,
+			ID:          occurrenceID(e),
+		}
+	}
+	return tes
+}
+
+// occurrenceID identifies a single occurrence of e's series, for use as a
+// stable key in URLs and in the generated ICS feed (mergedCalendar). A
+// VEVENT's UID alone isn't enough: every occurrence of a recurring event
+// shares it.
+func occurrenceID(e event) string {
+	uid := e.uid
+	if uid == "" {
+		uid = newUID()
+	}
+	return uid + "-" + e.start.UTC().Format("20060102T150405Z")
+}
+
+func (s *server) renderEvents(w http.ResponseWriter, title string, start, end time.Time) {
+	es, err := queryEvents(s.client, s.calendars, start, end, true, s.cache)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	data := struct {
+		Title  string
+		Events []templateEvent
+	}{title, toTemplateEvents(es)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, data); err != nil {
+		log.Println("executing template:", err)
+	}
+}
+
+func (s *server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		http.Redirect(w, r, "/agenda", http.StatusFound)
+		return
+	}
+	if name, ok := strings.CutSuffix(r.URL.Path, "/calendar.ics"); ok {
+		s.handleCalendarICS(w, r, strings.Trim(name, "/"))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func queryDate(r *http.Request, layout string) (time.Time, error) {
+	s := r.URL.Query().Get("date")
+	if s == "" {
+		return time.Now(), nil
+	}
+	return time.ParseInLocation(layout, s, time.Local)
+}
+
+func (s *server) handleMonth(w http.ResponseWriter, r *http.Request) {
+	date, err := queryDate(r, "2006-01")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 1, 0)
+	s.renderEvents(w, fmt.Sprintf("%v", start.Format("January 2006")), start, end)
+}
+
+func (s *server) handleWeek(w http.ResponseWriter, r *http.Request) {
+	date, err := queryDate(r, "2006-01-02")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset := (int(date.Weekday()) + 6) % 7 // days since Monday
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local).
+		AddDate(0, 0, -offset)
+	end := start.AddDate(0, 0, 7)
+	s.renderEvents(w, fmt.Sprintf("Week of %v", start.Format("2006-01-02")), start, end)
+}
+
+func (s *server) handleAgenda(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if ds := r.URL.Query().Get("days"); ds != "" {
+		n, err := strconv.Atoi(ds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	start := time.Now()
+	end := start.AddDate(0, 0, days)
+	s.renderEvents(w, "Agenda", start, end)
+}
+
+func (s *server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len("/event/"):]
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// There's no index from occurrence ID to event, so we search a wide
+	// window around the current date.
+	start := time.Now().AddDate(0, -6, 0)
+	end := time.Now().AddDate(0, 6, 0)
+	es, err := queryEvents(s.client, s.calendars, start, end, true, s.cache)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for _, e := range es {
+		if occurrenceID(e) != id {
+			continue
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := eventTemplate.Execute(w, toTemplateEvents([]event{e})[0]); err != nil {
+			log.Println("executing template:", err)
+		}
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// windowFromQuery parses the ?days= query parameter used by the
+// subscription endpoints, defaulting to 90 days starting now.
+func windowFromQuery(r *http.Request) (start, end time.Time, err error) {
+	days := 90
+	if ds := r.URL.Query().Get("days"); ds != "" {
+		days, err = strconv.Atoi(ds)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	start = time.Now()
+	end = start.AddDate(0, 0, days)
+	return start, end, nil
+}
+
+func (s *server) handleCalendarICS(w http.ResponseWriter, r *http.Request, calendarName string) {
+	calendars := s.calendars
+	if calendarName != "" {
+		cal, err := findCalendar(s.calendars, calendarName)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		calendars = []caldav.Calendar{cal}
+	}
+	start, end, err := windowFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	es, err := queryEvents(s.client, calendars, start, end, true, s.cache)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", ical.MIMEType)
+	if len(es) == 0 {
+		// go-ical's encoder refuses to encode a VCALENDAR with no children,
+		// but an empty window is a perfectly valid subscription result.
+		io.WriteString(w, "BEGIN:VCALENDAR\r\nPRODID:-//jech/ical//EN\r\nVERSION:2.0\r\nEND:VCALENDAR\r\n")
+		return
+	}
+	if err := ical.NewEncoder(w).Encode(mergedCalendar(es)); err != nil {
+		log.Println("encoding calendar:", err)
+	}
+}
+
+func (s *server) handleFreeBusy(w http.ResponseWriter, r *http.Request) {
+	start, end, err := windowFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	intervals, err := computeFreeBusy(s.client, s.hclient, s.endpoint, s.calendars, start, end, s.cache)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", ical.MIMEType)
+	if err := writeFreeBusyICS(w, start, end, intervals); err != nil {
+		log.Println("encoding freebusy:", err)
+	}
+}
+
+// mergedCalendar builds a single VCALENDAR containing one VEVENT per
+// occurrence in es, suitable for publishing as a subscription feed.
+func mergedCalendar(es []event) *ical.Calendar {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropProductID, "-//jech/ical//EN")
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	now := time.Now()
+	for _, e := range es {
+		ev := ical.NewEvent()
+		ev.Props.SetText(ical.PropUID, occurrenceID(e))
+		ev.Props.SetDateTime(ical.PropDateTimeStamp, now)
+		ev.Props.SetDateTime(ical.PropDateTimeStart, e.start)
+		ev.Props.SetDateTime(ical.PropDateTimeEnd, e.end)
+		ev.Props.SetText(ical.PropSummary, e.summary)
+		if e.location != "" {
+			ev.Props.SetText(ical.PropLocation, e.location)
+		}
+		if e.description != "" {
+			ev.Props.SetText(ical.PropDescription, e.description)
+		}
+		cal.Children = append(cal.Children, ev.Component)
+	}
+	return cal
+}